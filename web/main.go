@@ -2,6 +2,9 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"compress/flate"
+	"crypto/rand"
 	"crypto/sha1"
 	"encoding/base64"
 	"encoding/binary"
@@ -11,28 +14,74 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"math"
+	"math/big"
 	"net"
 	"net/http"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 )
 
 const (
-	opText  = 1
-	opClose = 8
-	opPing  = 9
-	opPong  = 10
+	opContinuation = 0
+	opText         = 1
+	opBinary       = 2
+	opClose        = 8
+	opPing         = 9
+	opPong         = 10
 )
 
+const (
+	// defaultMaxMessageSize bounds a reassembled WebSocket message (after
+	// joining continuation frames, before decompression). It is checked
+	// against each frame's declared length before any payload is
+	// allocated, so an attacker can't force a multi-exabyte make([]byte).
+	defaultMaxMessageSize = 1 << 20
+
+	// deflateWindowSize is the maximum permessage-deflate LZ77 window: the
+	// dictionary carried into the next message under context takeover is
+	// trimmed to this many trailing bytes.
+	deflateWindowSize = 32768
+
+	readDeadline = 60 * time.Second
+	pingInterval = 20 * time.Second
+)
+
+// deflateTrailer is the 4-byte sync-flush marker permessage-deflate strips
+// from the wire and the receiver re-appends before inflating.
+var deflateTrailer = []byte{0x00, 0x00, 0xff, 0xff}
+
+// deflateFinalBlock is an empty, final (BFINAL=1) stored block. The
+// sync-flush marker alone is *not* final, so compress/flate keeps expecting
+// more blocks after it; feeding it nothing but deflateTrailer makes
+// io.ReadAll's trailing Read return io.ErrUnexpectedEOF instead of io.EOF
+// once the real payload is exhausted. Appending this after deflateTrailer
+// gives the decompressor a true end of stream to terminate on.
+var deflateFinalBlock = []byte{0x01, 0x00, 0x00, 0xff, 0xff}
+
 type ClientMessage struct {
-	Type       string `json:"type"`
-	Uci        string `json:"uci,omitempty"`
-	Color      string `json:"color,omitempty"`
-	MovetimeMs int    `json:"movetime_ms,omitempty"`
+	Type       string       `json:"type"`
+	Uci        string       `json:"uci,omitempty"`
+	Color      string       `json:"color,omitempty"`
+	MovetimeMs int          `json:"movetime_ms,omitempty"`
+	Passphrase string       `json:"passphrase,omitempty"`
+	Token      string       `json:"token,omitempty"`
+	Tc         *TimeControl `json:"tc,omitempty"`
+	Fen        string       `json:"fen,omitempty"`
+	Moves      []string     `json:"moves,omitempty"`
+}
+
+// TimeControl configures a real chess clock for a "new" game: both sides
+// start with InitialMs and gain IncrementMs after each accepted move.
+type TimeControl struct {
+	InitialMs   int `json:"initial_ms"`
+	IncrementMs int `json:"increment_ms"`
 }
 
 type ServerMessage struct {
@@ -42,12 +91,52 @@ type ServerMessage struct {
 	EngineMove string   `json:"engine_move,omitempty"`
 	Status     string   `json:"status,omitempty"`
 	Message    string   `json:"message,omitempty"`
+	Passphrase string   `json:"passphrase,omitempty"`
+	Token      string   `json:"token,omitempty"`
+	Depth      int      `json:"depth,omitempty"`
+	ScoreCp    int      `json:"score_cp,omitempty"`
+	Mate       int      `json:"mate,omitempty"`
+	Nodes      int64    `json:"nodes,omitempty"`
+	Nps        int64    `json:"nps,omitempty"`
+	Pv         []string `json:"pv,omitempty"`
+	WhiteMs    int      `json:"white_ms,omitempty"`
+	BlackMs    int      `json:"black_ms,omitempty"`
+	Pgn        string   `json:"pgn,omitempty"`
+}
+
+func infoServerMessage(update InfoUpdate) ServerMessage {
+	msg := ServerMessage{
+		Type:  "info",
+		Depth: update.Depth,
+		Nodes: update.Nodes,
+		Nps:   update.Nps,
+		Pv:    update.Pv,
+	}
+	if update.HasMate {
+		msg.Mate = update.Mate
+	} else {
+		msg.ScoreCp = update.ScoreCp
+	}
+	return msg
 }
 
+// WsConn is a hand-rolled RFC 6455 connection. It reassembles fragmented
+// messages, enforces maxMessageSize before allocating any frame payload,
+// and optionally speaks the permessage-deflate extension with context
+// takeover in both directions. The public surface (ReadMessage/WriteMessage/
+// WriteJSON) is unchanged by any of that so callers don't need to care.
 type WsConn struct {
-	conn    net.Conn
-	reader  *bufio.Reader
-	writeMu sync.Mutex
+	conn           net.Conn
+	reader         *bufio.Reader
+	writeMu        sync.Mutex
+	maxMessageSize int
+
+	deflate                bool
+	noContextTakeoverRead  bool // "client_no_context_takeover": resets the read-side dictionary every message
+	noContextTakeoverWrite bool // "server_no_context_takeover": resets the write-side dictionary every message
+	readDict               []byte
+	writeDict              []byte
+	flateReader            io.ReadCloser
 }
 
 func (c *WsConn) Close() error {
@@ -55,24 +144,74 @@ func (c *WsConn) Close() error {
 }
 
 func (c *WsConn) ReadMessage() ([]byte, error) {
+	var message []byte
+	var messageOpcode byte
+	var compressed bool
+
 	for {
-		opcode, payload, err := readFrame(c.reader)
+		opcode, fin, rsv1, payload, err := readFrame(c.reader, c.maxMessageSize)
 		if err != nil {
 			return nil, err
 		}
+		_ = c.conn.SetReadDeadline(time.Now().Add(readDeadline))
+
 		switch opcode {
-		case opText:
-			return payload, nil
 		case opPing:
-			_ = c.writeFrame(opPong, payload)
+			_ = c.writeFrame(opPong, payload, false)
+			continue
+		case opPong:
+			continue
 		case opClose:
 			return nil, io.EOF
+		case opContinuation:
+			if messageOpcode == 0 {
+				return nil, errors.New("continuation frame with no preceding message")
+			}
+			if len(message)+len(payload) > c.maxMessageSize {
+				return nil, fmt.Errorf("reassembled message exceeds %d bytes", c.maxMessageSize)
+			}
+			message = append(message, payload...)
+		case opText, opBinary:
+			if messageOpcode != 0 {
+				return nil, errors.New("expected continuation frame")
+			}
+			messageOpcode = opcode
+			compressed = rsv1
+			message = payload
+		default:
+			return nil, fmt.Errorf("unsupported opcode %d", opcode)
+		}
+
+		if fin {
+			break
 		}
 	}
+
+	if compressed {
+		return c.inflate(message)
+	}
+	return message, nil
 }
 
+// WriteMessage compresses (if negotiated) and writes payload as one text
+// frame. Compression and the frame write happen under the same writeMu
+// critical section: two goroutines can legitimately call WriteMessage on the
+// same WsConn concurrently (e.g. the move-goroutine's info callback racing
+// the main loop's own reply), and permessage-deflate's context takeover
+// means the write-side dictionary must evolve in exactly the order frames
+// hit the wire — deriving it outside the lock could desync the client's
+// decompressor for the rest of the connection.
 func (c *WsConn) WriteMessage(payload []byte) error {
-	return c.writeFrame(opText, payload)
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.deflate {
+		compressed, err := c.compressLocked(payload)
+		if err != nil {
+			return err
+		}
+		return c.writeFrameLocked(opText, compressed, true)
+	}
+	return c.writeFrameLocked(opText, payload, false)
 }
 
 func (c *WsConn) WriteJSON(value any) error {
@@ -83,12 +222,108 @@ func (c *WsConn) WriteJSON(value any) error {
 	return c.WriteMessage(payload)
 }
 
-func (c *WsConn) writeFrame(opcode byte, payload []byte) error {
+// startKeepalive arms the initial read deadline and begins sending pings so
+// a peer that vanishes without a close handshake is eventually reaped.
+func (c *WsConn) startKeepalive() {
+	_ = c.conn.SetReadDeadline(time.Now().Add(readDeadline))
+	go func() {
+		ticker := time.NewTicker(pingInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if err := c.writeFrame(opPing, nil, false); err != nil {
+				return
+			}
+		}
+	}()
+}
+
+// inflate decompresses one permessage-deflate payload, maintaining the
+// sliding-window dictionary across calls unless client_no_context_takeover
+// was negotiated. The decompressed size is capped at maxMessageSize — the
+// wire frame is already bounded by that same limit (see readFrame), but
+// deflate can expand a sub-limit payload by orders of magnitude, so the
+// limit has to be enforced again on the inflate side or a small frame can
+// still bomb the server into allocating gigabytes.
+func (c *WsConn) inflate(payload []byte) ([]byte, error) {
+	tail := append(append([]byte(nil), deflateTrailer...), deflateFinalBlock...)
+	source := bytes.NewReader(append(append([]byte(nil), payload...), tail...))
+	if c.flateReader == nil {
+		c.flateReader = flate.NewReader(source)
+	} else if err := c.flateReader.(flate.Resetter).Reset(source, c.readDict); err != nil {
+		return nil, err
+	}
+
+	limited := io.LimitReader(c.flateReader, int64(c.maxMessageSize)+1)
+	out, err := io.ReadAll(limited)
+	if err != nil {
+		return nil, err
+	}
+	if len(out) > c.maxMessageSize {
+		return nil, fmt.Errorf("decompressed message exceeds %d bytes", c.maxMessageSize)
+	}
+	if c.noContextTakeoverRead {
+		c.readDict = nil
+	} else {
+		c.readDict = deflateWindow(c.readDict, out)
+	}
+	return out, nil
+}
+
+// compressLocked compresses one message for permessage-deflate, seeding the
+// compressor with the dictionary from prior messages unless
+// server_no_context_takeover was negotiated. Caller must hold writeMu.
+func (c *WsConn) compressLocked(payload []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	var writer *flate.Writer
+	var err error
+	if len(c.writeDict) == 0 {
+		writer, err = flate.NewWriter(&buf, flate.DefaultCompression)
+	} else {
+		writer, err = flate.NewWriterDict(&buf, flate.DefaultCompression, c.writeDict)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if _, err := writer.Write(payload); err != nil {
+		return nil, err
+	}
+	if err := writer.Flush(); err != nil {
+		return nil, err
+	}
+
+	if c.noContextTakeoverWrite {
+		c.writeDict = nil
+	} else {
+		c.writeDict = deflateWindow(c.writeDict, payload)
+	}
+	return bytes.TrimSuffix(buf.Bytes(), deflateTrailer), nil
+}
+
+// deflateWindow appends fresh bytes onto a dictionary and trims it to the
+// trailing deflateWindowSize bytes, which is all flate's LZ77 window can
+// reference anyway.
+func deflateWindow(dict, fresh []byte) []byte {
+	combined := append(append([]byte(nil), dict...), fresh...)
+	if len(combined) > deflateWindowSize {
+		combined = combined[len(combined)-deflateWindowSize:]
+	}
+	return combined
+}
+
+func (c *WsConn) writeFrame(opcode byte, payload []byte, rsv1 bool) error {
 	c.writeMu.Lock()
 	defer c.writeMu.Unlock()
+	return c.writeFrameLocked(opcode, payload, rsv1)
+}
 
+// writeFrameLocked writes one frame to the wire. Caller must hold writeMu.
+func (c *WsConn) writeFrameLocked(opcode byte, payload []byte, rsv1 bool) error {
+	firstByte := byte(0x80 | opcode)
+	if rsv1 {
+		firstByte |= 0x40
+	}
 	header := make([]byte, 0, 14)
-	header = append(header, 0x80|opcode)
+	header = append(header, firstByte)
 	length := len(payload)
 	switch {
 	case length < 126:
@@ -112,52 +347,55 @@ func (c *WsConn) writeFrame(opcode byte, payload []byte) error {
 	return err
 }
 
-func readFrame(reader *bufio.Reader) (byte, []byte, error) {
+// readFrame reads one WebSocket frame, rejecting (without allocating a
+// payload buffer) any frame whose declared length exceeds maxSize.
+func readFrame(reader *bufio.Reader, maxSize int) (opcode byte, fin bool, rsv1 bool, payload []byte, err error) {
 	b1, err := reader.ReadByte()
 	if err != nil {
-		return 0, nil, err
+		return 0, false, false, nil, err
 	}
 	b2, err := reader.ReadByte()
 	if err != nil {
-		return 0, nil, err
+		return 0, false, false, nil, err
 	}
-	fin := b1 & 0x80
-	opcode := b1 & 0x0f
+	fin = b1&0x80 != 0
+	rsv1 = b1&0x40 != 0
+	opcode = b1 & 0x0f
 	masked := b2 & 0x80
 	length := int(b2 & 0x7f)
 
-	if fin == 0 {
-		return 0, nil, errors.New("fragmented frames not supported")
-	}
-
 	if length == 126 {
 		buf := make([]byte, 2)
 		if _, err := io.ReadFull(reader, buf); err != nil {
-			return 0, nil, err
+			return 0, false, false, nil, err
 		}
 		length = int(binary.BigEndian.Uint16(buf))
 	} else if length == 127 {
 		buf := make([]byte, 8)
 		if _, err := io.ReadFull(reader, buf); err != nil {
-			return 0, nil, err
+			return 0, false, false, nil, err
 		}
 		payloadLen := binary.BigEndian.Uint64(buf)
 		if payloadLen > uint64(^uint(0)>>1) {
-			return 0, nil, errors.New("payload too large")
+			return 0, false, false, nil, errors.New("payload too large")
 		}
 		length = int(payloadLen)
 	}
 
+	if length > maxSize {
+		return 0, false, false, nil, fmt.Errorf("frame payload of %d bytes exceeds max message size %d", length, maxSize)
+	}
+
 	var maskKey [4]byte
 	if masked != 0 {
 		if _, err := io.ReadFull(reader, maskKey[:]); err != nil {
-			return 0, nil, err
+			return 0, false, false, nil, err
 		}
 	}
 
-	payload := make([]byte, length)
+	payload = make([]byte, length)
 	if _, err := io.ReadFull(reader, payload); err != nil {
-		return 0, nil, err
+		return 0, false, false, nil, err
 	}
 
 	if masked != 0 {
@@ -166,10 +404,10 @@ func readFrame(reader *bufio.Reader) (byte, []byte, error) {
 		}
 	}
 
-	return opcode, payload, nil
+	return opcode, fin, rsv1, payload, nil
 }
 
-func upgradeToWebSocket(w http.ResponseWriter, r *http.Request) (*WsConn, error) {
+func upgradeToWebSocket(w http.ResponseWriter, r *http.Request, maxMessageSize int) (*WsConn, error) {
 	if !headerContains(r.Header, "Connection", "upgrade") ||
 		!strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
 		return nil, errors.New("not a websocket request")
@@ -185,6 +423,8 @@ func upgradeToWebSocket(w http.ResponseWriter, r *http.Request) (*WsConn, error)
 		return nil, errors.New("invalid websocket key")
 	}
 
+	deflate, clientNoContextTakeover, serverNoContextTakeover := negotiatePermessageDeflate(r.Header)
+
 	hijacker, ok := w.(http.Hijacker)
 	if !ok {
 		return nil, errors.New("hijacking not supported")
@@ -198,14 +438,63 @@ func upgradeToWebSocket(w http.ResponseWriter, r *http.Request) (*WsConn, error)
 	response := "HTTP/1.1 101 Switching Protocols\r\n" +
 		"Upgrade: websocket\r\n" +
 		"Connection: Upgrade\r\n" +
-		"Sec-WebSocket-Accept: " + accept + "\r\n\r\n"
+		"Sec-WebSocket-Accept: " + accept + "\r\n"
+	if deflate {
+		response += "Sec-WebSocket-Extensions: " + permessageDeflateReply(clientNoContextTakeover, serverNoContextTakeover) + "\r\n"
+	}
+	response += "\r\n"
 
 	if _, err := conn.Write([]byte(response)); err != nil {
 		_ = conn.Close()
 		return nil, err
 	}
 
-	return &WsConn{conn: conn, reader: bufio.NewReader(conn)}, nil
+	ws := &WsConn{
+		conn:                   conn,
+		reader:                 bufio.NewReader(conn),
+		maxMessageSize:         maxMessageSize,
+		deflate:                deflate,
+		noContextTakeoverRead:  clientNoContextTakeover,
+		noContextTakeoverWrite: serverNoContextTakeover,
+	}
+	ws.startKeepalive()
+	return ws, nil
+}
+
+// negotiatePermessageDeflate inspects the client's offered
+// Sec-WebSocket-Extensions and decides whether to accept permessage-deflate,
+// honoring whichever no_context_takeover flags it asked for.
+func negotiatePermessageDeflate(header http.Header) (accepted, clientNoContextTakeover, serverNoContextTakeover bool) {
+	for _, line := range header.Values("Sec-WebSocket-Extensions") {
+		for _, offer := range strings.Split(line, ",") {
+			params := strings.Split(offer, ";")
+			if !strings.EqualFold(strings.TrimSpace(params[0]), "permessage-deflate") {
+				continue
+			}
+			accepted = true
+			for _, param := range params[1:] {
+				switch strings.TrimSpace(param) {
+				case "client_no_context_takeover":
+					clientNoContextTakeover = true
+				case "server_no_context_takeover":
+					serverNoContextTakeover = true
+				}
+			}
+			return accepted, clientNoContextTakeover, serverNoContextTakeover
+		}
+	}
+	return false, false, false
+}
+
+func permessageDeflateReply(clientNoContextTakeover, serverNoContextTakeover bool) string {
+	reply := "permessage-deflate"
+	if clientNoContextTakeover {
+		reply += "; client_no_context_takeover"
+	}
+	if serverNoContextTakeover {
+		reply += "; server_no_context_takeover"
+	}
+	return reply
 }
 
 func headerContains(header http.Header, key, value string) bool {
@@ -225,11 +514,18 @@ func computeAcceptKey(key string) string {
 	return base64.StdEncoding.EncodeToString(hash[:])
 }
 
+// EngineProcess wraps a UCI engine subprocess. A single reader goroutine
+// owns stdout and fans each line out over lines, so a writer (Stop) can
+// reach stdin while a reader (BestMoveStream) is mid-search without either
+// blocking on the other. callMu still serializes the request/response
+// command cycle itself (legalmoves/fen/incheck/go), since the engine can
+// only usefully answer one such request at a time.
 type EngineProcess struct {
-	cmd    *exec.Cmd
-	stdin  io.WriteCloser
-	stdout *bufio.Reader
-	mu     sync.Mutex
+	cmd     *exec.Cmd
+	stdin   io.WriteCloser
+	stdinMu sync.Mutex
+	callMu  sync.Mutex
+	lines   chan string
 }
 
 func startEngine(path string) (*EngineProcess, error) {
@@ -250,10 +546,11 @@ func startEngine(path string) (*EngineProcess, error) {
 		return nil, err
 	}
 	engine := &EngineProcess{
-		cmd:    cmd,
-		stdin:  stdin,
-		stdout: bufio.NewReader(stdoutPipe),
+		cmd:   cmd,
+		stdin: stdin,
+		lines: make(chan string, 64),
 	}
+	go engine.readLoop(stdoutPipe)
 	if err := engine.handshake(); err != nil {
 		engine.Close()
 		return nil, err
@@ -261,46 +558,67 @@ func startEngine(path string) (*EngineProcess, error) {
 	return engine, nil
 }
 
+func (e *EngineProcess) readLoop(stdout io.Reader) {
+	reader := bufio.NewReader(stdout)
+	for {
+		line, err := reader.ReadString('\n')
+		if line != "" {
+			e.lines <- strings.TrimSpace(line)
+		}
+		if err != nil {
+			close(e.lines)
+			return
+		}
+	}
+}
+
 func (e *EngineProcess) Close() {
-	e.mu.Lock()
-	defer e.mu.Unlock()
+	e.stdinMu.Lock()
 	_, _ = io.WriteString(e.stdin, "quit\n")
 	_ = e.stdin.Close()
+	e.stdinMu.Unlock()
 	_ = e.cmd.Wait()
 }
 
+// Stop asks the engine to cut its current search short and report the best
+// move found so far. It only takes stdinMu, so it can run while another
+// goroutine is blocked in callMu waiting out a BestMoveStream call.
+func (e *EngineProcess) Stop() error {
+	return e.send("stop")
+}
+
 func (e *EngineProcess) handshake() error {
-	e.mu.Lock()
-	defer e.mu.Unlock()
-	if err := e.sendLocked("uci"); err != nil {
+	e.callMu.Lock()
+	defer e.callMu.Unlock()
+	if err := e.send("uci"); err != nil {
 		return err
 	}
-	if _, err := e.waitForPrefixLocked("uciok"); err != nil {
+	if _, err := e.waitForPrefix("uciok"); err != nil {
 		return err
 	}
-	if err := e.sendLocked("isready"); err != nil {
+	if err := e.send("isready"); err != nil {
 		return err
 	}
-	_, err := e.waitForPrefixLocked("readyok")
+	_, err := e.waitForPrefix("readyok")
 	return err
 }
 
 func (e *EngineProcess) NewGame() error {
-	e.mu.Lock()
-	defer e.mu.Unlock()
-	return e.sendLocked("ucinewgame")
+	e.callMu.Lock()
+	defer e.callMu.Unlock()
+	return e.send("ucinewgame")
 }
 
-func (e *EngineProcess) LegalMoves(moves []string) ([]string, error) {
-	e.mu.Lock()
-	defer e.mu.Unlock()
-	if err := e.sendLocked(buildPositionCommand(moves)); err != nil {
+func (e *EngineProcess) LegalMoves(base string, moves []string) ([]string, error) {
+	e.callMu.Lock()
+	defer e.callMu.Unlock()
+	if err := e.send(buildPositionCommand(base, moves)); err != nil {
 		return nil, err
 	}
-	if err := e.sendLocked("legalmoves"); err != nil {
+	if err := e.send("legalmoves"); err != nil {
 		return nil, err
 	}
-	line, err := e.waitForPrefixLocked("legalmoves")
+	line, err := e.waitForPrefix("legalmoves")
 	if err != nil {
 		return nil, err
 	}
@@ -311,26 +629,68 @@ func (e *EngineProcess) LegalMoves(moves []string) ([]string, error) {
 	return fields[1:], nil
 }
 
-func (e *EngineProcess) BestMove(moves []string, depth int, movetimeMs int) (string, error) {
-	e.mu.Lock()
-	defer e.mu.Unlock()
-	if err := e.sendLocked(buildPositionCommand(moves)); err != nil {
+// InfoUpdate is one parsed UCI "info ..." line emitted while the engine is
+// searching.
+type InfoUpdate struct {
+	Depth   int
+	ScoreCp int
+	Mate    int
+	HasMate bool
+	Nodes   int64
+	Nps     int64
+	TimeMs  int64
+	Pv      []string
+}
+
+// SearchLimits selects how EngineProcess paces a "go" command: either a
+// fixed depth/movetime (untimed play) or a real clock, in which case the
+// engine paces itself via UCI's wtime/btime/winc/binc.
+type SearchLimits struct {
+	Depth      int
+	MovetimeMs int
+	UseClock   bool
+	WhiteMs    int
+	BlackMs    int
+	WhiteIncMs int
+	BlackIncMs int
+}
+
+func (l SearchLimits) goCommand() string {
+	switch {
+	case l.UseClock:
+		return fmt.Sprintf("go wtime %d btime %d winc %d binc %d", l.WhiteMs, l.BlackMs, l.WhiteIncMs, l.BlackIncMs)
+	case l.MovetimeMs > 0:
+		return fmt.Sprintf("go movetime %d", l.MovetimeMs)
+	default:
+		return fmt.Sprintf("go depth %d", l.Depth)
+	}
+}
+
+// BestMoveStream behaves like BestMove but invokes onInfo (if non-nil) for
+// every "info" line the engine prints while thinking, so a caller can relay
+// live analysis to a client before the final "bestmove" arrives.
+func (e *EngineProcess) BestMoveStream(base string, moves []string, limits SearchLimits, onInfo func(InfoUpdate)) (string, error) {
+	e.callMu.Lock()
+	defer e.callMu.Unlock()
+	if err := e.send(buildPositionCommand(base, moves)); err != nil {
 		return "", err
 	}
-	if movetimeMs > 0 {
-		if err := e.sendLocked(fmt.Sprintf("go movetime %d", movetimeMs)); err != nil {
-			return "", err
-		}
-	} else {
-		if err := e.sendLocked(fmt.Sprintf("go depth %d", depth)); err != nil {
-			return "", err
-		}
+	if err := e.send(limits.goCommand()); err != nil {
+		return "", err
 	}
 	for {
-		line, err := e.readLineLocked()
+		line, err := e.readLine()
 		if err != nil {
 			return "", err
 		}
+		if strings.HasPrefix(line, "info ") {
+			if onInfo != nil {
+				if update, ok := parseInfoLine(line); ok {
+					onInfo(update)
+				}
+			}
+			continue
+		}
 		if strings.HasPrefix(line, "bestmove ") {
 			parts := strings.Fields(line)
 			if len(parts) >= 2 {
@@ -341,32 +701,54 @@ func (e *EngineProcess) BestMove(moves []string, depth int, movetimeMs int) (str
 	}
 }
 
-func (e *EngineProcess) Fen(moves []string) (string, error) {
-	e.mu.Lock()
-	defer e.mu.Unlock()
-	if err := e.sendLocked(buildPositionCommand(moves)); err != nil {
+func (e *EngineProcess) BestMove(base string, moves []string, limits SearchLimits) (string, error) {
+	return e.BestMoveStream(base, moves, limits, nil)
+}
+
+func (e *EngineProcess) Fen(base string, moves []string) (string, error) {
+	e.callMu.Lock()
+	defer e.callMu.Unlock()
+	if err := e.send(buildPositionCommand(base, moves)); err != nil {
 		return "", err
 	}
-	if err := e.sendLocked("fen"); err != nil {
+	if err := e.send("fen"); err != nil {
 		return "", err
 	}
-	line, err := e.waitForPrefixLocked("fen ")
+	line, err := e.waitForPrefix("fen ")
 	if err != nil {
 		return "", err
 	}
 	return strings.TrimPrefix(line, "fen "), nil
 }
 
-func (e *EngineProcess) InCheck(moves []string) (bool, error) {
-	e.mu.Lock()
-	defer e.mu.Unlock()
-	if err := e.sendLocked(buildPositionCommand(moves)); err != nil {
+// San converts moves[len(moves)-1] to SAN, given the position reached after
+// moves[:len(moves)-1]. It is only valid when moves is non-empty.
+func (e *EngineProcess) San(base string, moves []string) (string, error) {
+	e.callMu.Lock()
+	defer e.callMu.Unlock()
+	if err := e.send(buildPositionCommand(base, moves[:len(moves)-1])); err != nil {
+		return "", err
+	}
+	if err := e.send("san " + moves[len(moves)-1]); err != nil {
+		return "", err
+	}
+	line, err := e.waitForPrefix("san ")
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimPrefix(line, "san "), nil
+}
+
+func (e *EngineProcess) InCheck(base string, moves []string) (bool, error) {
+	e.callMu.Lock()
+	defer e.callMu.Unlock()
+	if err := e.send(buildPositionCommand(base, moves)); err != nil {
 		return false, err
 	}
-	if err := e.sendLocked("incheck"); err != nil {
+	if err := e.send("incheck"); err != nil {
 		return false, err
 	}
-	line, err := e.waitForPrefixLocked("incheck")
+	line, err := e.waitForPrefix("incheck")
 	if err != nil {
 		return false, err
 	}
@@ -377,22 +759,24 @@ func (e *EngineProcess) InCheck(moves []string) (bool, error) {
 	return fields[1] == "1", nil
 }
 
-func (e *EngineProcess) sendLocked(command string) error {
+func (e *EngineProcess) send(command string) error {
+	e.stdinMu.Lock()
+	defer e.stdinMu.Unlock()
 	_, err := io.WriteString(e.stdin, command+"\n")
 	return err
 }
 
-func (e *EngineProcess) readLineLocked() (string, error) {
-	line, err := e.stdout.ReadString('\n')
-	if err != nil {
-		return "", err
+func (e *EngineProcess) readLine() (string, error) {
+	line, ok := <-e.lines
+	if !ok {
+		return "", io.EOF
 	}
-	return strings.TrimSpace(line), nil
+	return line, nil
 }
 
-func (e *EngineProcess) waitForPrefixLocked(prefix string) (string, error) {
+func (e *EngineProcess) waitForPrefix(prefix string) (string, error) {
 	for {
-		line, err := e.readLineLocked()
+		line, err := e.readLine()
 		if err != nil {
 			return "", err
 		}
@@ -402,19 +786,157 @@ func (e *EngineProcess) waitForPrefixLocked(prefix string) (string, error) {
 	}
 }
 
-func buildPositionCommand(moves []string) string {
+func parseInfoLine(line string) (InfoUpdate, bool) {
+	fields := strings.Fields(line)
+	var update InfoUpdate
+	found := false
+	for i := 0; i < len(fields); i++ {
+		switch fields[i] {
+		case "depth":
+			if i+1 < len(fields) {
+				update.Depth, _ = strconv.Atoi(fields[i+1])
+				found = true
+			}
+		case "score":
+			if i+2 < len(fields) {
+				switch fields[i+1] {
+				case "cp":
+					update.ScoreCp, _ = strconv.Atoi(fields[i+2])
+					found = true
+				case "mate":
+					update.Mate, _ = strconv.Atoi(fields[i+2])
+					update.HasMate = true
+					found = true
+				}
+			}
+		case "nodes":
+			if i+1 < len(fields) {
+				update.Nodes, _ = strconv.ParseInt(fields[i+1], 10, 64)
+			}
+		case "nps":
+			if i+1 < len(fields) {
+				update.Nps, _ = strconv.ParseInt(fields[i+1], 10, 64)
+			}
+		case "time":
+			if i+1 < len(fields) {
+				update.TimeMs, _ = strconv.ParseInt(fields[i+1], 10, 64)
+			}
+		case "pv":
+			update.Pv = append([]string(nil), fields[i+1:]...)
+			i = len(fields)
+		}
+	}
+	return update, found
+}
+
+var (
+	fenBoardPattern     = regexp.MustCompile(`^[pnbrqkPNBRQK1-8]{1,8}(/[pnbrqkPNBRQK1-8]{1,8}){7}$`)
+	fenCastlingPattern  = regexp.MustCompile(`^(-|[KQkq]{1,4})$`)
+	fenEnPassantPattern = regexp.MustCompile(`^(-|[a-h][36])$`)
+	uciMovePattern      = regexp.MustCompile(`^[a-h][1-8][a-h][1-8][qrbn]?$`)
+)
+
+// sanitizeFEN validates fen against the six-field FEN grammar and, on
+// success, returns it rebuilt from the individual fields rather than the raw
+// input — so a string that merely contains six validly-shaped fields
+// separated by stray whitespace (e.g. an embedded newline) can't carry that
+// whitespace through to the engine's stdin as an extra command line.
+func sanitizeFEN(fen string) (string, bool) {
+	fields := strings.Fields(fen)
+	if len(fields) != 6 {
+		return "", false
+	}
+	if !fenBoardPattern.MatchString(fields[0]) {
+		return "", false
+	}
+	if fields[1] != "w" && fields[1] != "b" {
+		return "", false
+	}
+	if !fenCastlingPattern.MatchString(fields[2]) {
+		return "", false
+	}
+	if !fenEnPassantPattern.MatchString(fields[3]) {
+		return "", false
+	}
+	if _, err := strconv.Atoi(fields[4]); err != nil {
+		return "", false
+	}
+	if _, err := strconv.Atoi(fields[5]); err != nil {
+		return "", false
+	}
+	return strings.Join(fields, " "), true
+}
+
+// sanitizeMoves validates each move against the UCI long-algebraic move
+// pattern, so a client can't smuggle extra UCI commands onto the engine's
+// stdin via a crafted "moves" element.
+func sanitizeMoves(moves []string) ([]string, bool) {
+	clean := make([]string, len(moves))
+	for i, move := range moves {
+		if !uciMovePattern.MatchString(move) {
+			return nil, false
+		}
+		clean[i] = move
+	}
+	return clean, true
+}
+
+// buildPositionCommand builds a UCI "position" command rooted at base (empty
+// meaning "startpos", otherwise a literal "fen <FEN>") with moves applied on
+// top of it.
+func buildPositionCommand(base string, moves []string) string {
+	if base == "" {
+		base = "startpos"
+	}
 	if len(moves) == 0 {
-		return "position startpos"
+		return "position " + base
 	}
-	return "position startpos moves " + strings.Join(moves, " ")
+	return "position " + base + " moves " + strings.Join(moves, " ")
 }
 
+// Session is normally driven by a single goroutine at a time (the WS
+// connection's runEngineMessageLoop), but the /pgn REST endpoint reads a
+// session's position from its own goroutine. mu guards exactly the fields
+// that second reader touches — position (basePosition/moves) and the game
+// metadata PGN() reports — so that cross-goroutine access never races.
 type Session struct {
 	engine        *EngineProcess
 	moves         []string
+	basePosition  string // "" means startpos, otherwise a literal "fen <FEN>"
 	depth         int
 	movetimeMs    int
 	playerIsWhite bool
+
+	clockRunning bool
+	initialMs    int
+	whiteMs      int
+	blackMs      int
+	incrementMs  int
+	turnStarted  time.Time
+
+	// lastStatus/lastMessage mirror the most recent SendState call, so a
+	// reconnecting client gets the game's true current status (e.g. "Game
+	// over" after a checkmate or time forfeit it missed while disconnected)
+	// instead of an assumed "Your move".
+	lastStatus  string
+	lastMessage string
+
+	mu sync.Mutex
+}
+
+// setPosition atomically replaces basePosition and moves.
+func (s *Session) setPosition(base string, moves []string) {
+	s.mu.Lock()
+	s.basePosition = base
+	s.moves = moves
+	s.mu.Unlock()
+}
+
+// appendMove atomically appends one move onto moves.
+func (s *Session) appendMove(move string) {
+	s.mu.Lock()
+	s.moves = append(s.moves, move)
+	s.mu.Unlock()
 }
 
 func sideToMoveIsWhite(moves []string) bool {
@@ -438,6 +960,32 @@ func gameOverMessage(moves []string, playerIsWhite bool, inCheck bool) string {
 	return "Checkmate. You win."
 }
 
+func timeForfeitMessage(playerForfeited bool) string {
+	if playerForfeited {
+		return "Time's up. Engine wins."
+	}
+	return "Time's up. You win."
+}
+
+// pgnResult derives the PGN "[Result]" tag from the game-over message set by
+// gameOverMessage/timeForfeitMessage. It returns "*" (game still in
+// progress, or result otherwise unknown) if message doesn't match one of
+// those.
+func pgnResult(message string, playerIsWhite bool) string {
+	playerWon := strings.Contains(message, "You win")
+	engineWon := strings.Contains(message, "Engine wins")
+	switch {
+	case strings.Contains(message, "Draw"):
+		return "1/2-1/2"
+	case playerWon == playerIsWhite && (playerWon || engineWon):
+		return "1-0"
+	case playerWon || engineWon:
+		return "0-1"
+	default:
+		return "*"
+	}
+}
+
 func parsePlayerColor(value string, fallback bool) bool {
 	if value == "" {
 		return fallback
@@ -445,57 +993,211 @@ func parsePlayerColor(value string, fallback bool) bool {
 	return !strings.EqualFold(strings.TrimSpace(value), "black")
 }
 
-func (s *Session) Reset(playerIsWhite bool) (string, string, string, error) {
+func (s *Session) remainingMs(isWhite bool) int {
+	if isWhite {
+		return s.whiteMs
+	}
+	return s.blackMs
+}
+
+func (s *Session) setRemainingMs(isWhite bool, ms int) {
+	if isWhite {
+		s.whiteMs = ms
+	} else {
+		s.blackMs = ms
+	}
+}
+
+// startClock marks the moment the side to move's clock starts ticking.
+func (s *Session) startClock() {
+	s.turnStarted = time.Now()
+}
+
+// tick charges the wall-clock time elapsed since startClock to isWhite's
+// clock, adding the increment on top unless that exhausts the clock first —
+// in which case it reports a time forfeit rather than applying increment.
+func (s *Session) tick(isWhite bool) (forfeited bool) {
+	if !s.clockRunning {
+		return false
+	}
+	elapsedMs := int(time.Since(s.turnStarted).Milliseconds())
+	remaining := s.remainingMs(isWhite) - elapsedMs
+	if remaining <= 0 {
+		s.setRemainingMs(isWhite, 0)
+		return true
+	}
+	s.setRemainingMs(isWhite, remaining+s.incrementMs)
+	return false
+}
+
+// searchLimits reports how the engine should pace its next "go": by real
+// clock when a TimeControl is active, otherwise by the fixed depth/movetime
+// configured for the server.
+func (s *Session) searchLimits() SearchLimits {
+	if !s.clockRunning {
+		return SearchLimits{Depth: s.depth, MovetimeMs: s.movetimeMs}
+	}
+	return SearchLimits{
+		UseClock:   true,
+		WhiteMs:    s.whiteMs,
+		BlackMs:    s.blackMs,
+		WhiteIncMs: s.incrementMs,
+		BlackIncMs: s.incrementMs,
+	}
+}
+
+func (s *Session) Reset(playerIsWhite bool, tc *TimeControl, onInfo func(InfoUpdate)) (string, string, string, error) {
+	s.mu.Lock()
 	s.moves = nil
+	s.basePosition = ""
 	s.playerIsWhite = playerIsWhite
+	if tc != nil {
+		s.clockRunning = true
+		s.initialMs = tc.InitialMs
+		s.whiteMs = tc.InitialMs
+		s.blackMs = tc.InitialMs
+		s.incrementMs = tc.IncrementMs
+	} else {
+		s.clockRunning = false
+	}
+	s.mu.Unlock()
 	if err := s.engine.NewGame(); err != nil {
 		return "", "", "", err
 	}
 	if playerIsWhite {
+		s.startClock()
 		return "Your move", "", "", nil
 	}
 
-	engineMoves, err := s.engine.LegalMoves(s.moves)
+	engineMoves, err := s.engine.LegalMoves(s.basePosition, s.moves)
 	if err != nil {
 		return "", "", "", err
 	}
 	if len(engineMoves) == 0 {
-		inCheck, err := s.engine.InCheck(s.moves)
+		inCheck, err := s.engine.InCheck(s.basePosition, s.moves)
 		if err != nil {
 			return "", "", "", err
 		}
 		return "Game over", gameOverMessage(s.moves, s.playerIsWhite, inCheck), "", nil
 	}
 
-	bestMove, err := s.engine.BestMove(s.moves, s.depth, s.movetimeMs)
+	s.startClock()
+	bestMove, err := s.engine.BestMoveStream(s.basePosition, s.moves, s.searchLimits(), onInfo)
 	if err != nil {
 		return "", "", "", err
 	}
+	if forfeited := s.tick(sideToMoveIsWhite(s.moves)); forfeited {
+		return "Game over", timeForfeitMessage(sideToMoveIsPlayer(s.moves, s.playerIsWhite)), "", nil
+	}
 	if bestMove == "" || bestMove == "(none)" || bestMove == "0000" {
-		inCheck, err := s.engine.InCheck(s.moves)
+		inCheck, err := s.engine.InCheck(s.basePosition, s.moves)
 		if err != nil {
 			return "", "", "", err
 		}
 		return "Game over", gameOverMessage(s.moves, s.playerIsWhite, inCheck), "", nil
 	}
-	s.moves = append(s.moves, bestMove)
+	s.appendMove(bestMove)
 
-	playerMoves, err := s.engine.LegalMoves(s.moves)
+	playerMoves, err := s.engine.LegalMoves(s.basePosition, s.moves)
 	if err != nil {
 		return "", "", "", err
 	}
 	if len(playerMoves) == 0 {
-		inCheck, err := s.engine.InCheck(s.moves)
+		inCheck, err := s.engine.InCheck(s.basePosition, s.moves)
 		if err != nil {
 			return "", "", "", err
 		}
 		return "Game over", gameOverMessage(s.moves, s.playerIsWhite, inCheck), bestMove, nil
 	}
+	s.startClock()
 	return "Your move", "", bestMove, nil
 }
 
+// LoadPosition resets the session onto an arbitrary FEN (plus any moves
+// already played from it) instead of the game's usual starting position, so
+// a client can study or continue an externally supplied position. It stops
+// any running clock, since the loaded position carries no time control.
+//
+// fen and moves come straight from the client and are spliced into a UCI
+// command sent to the engine's stdin, so both are validated against their
+// expected grammars first — anything else (most importantly embedded
+// newlines, which would smuggle extra UCI commands such as "quit" onto the
+// engine's stdin) is rejected rather than passed through.
+func (s *Session) LoadPosition(fen string, moves []string) error {
+	cleanFEN, ok := sanitizeFEN(fen)
+	if !ok {
+		return errors.New("invalid fen")
+	}
+	cleanMoves, ok := sanitizeMoves(moves)
+	if !ok {
+		return errors.New("invalid move in moves list")
+	}
+	if err := s.engine.NewGame(); err != nil {
+		return err
+	}
+	s.setPosition("fen "+cleanFEN, cleanMoves)
+	s.mu.Lock()
+	s.clockRunning = false
+	s.mu.Unlock()
+	return nil
+}
+
+// PGN renders the game played so far as a PGN string, converting each UCI
+// move to SAN via the engine's "san" extension command. It may be called
+// from a goroutine other than the one driving the live session (the /pgn
+// REST endpoint), so it snapshots the position and game metadata under mu
+// before doing any (potentially slow) engine I/O.
+func (s *Session) PGN() (string, error) {
+	s.mu.Lock()
+	base := s.basePosition
+	moves := append([]string(nil), s.moves...)
+	playerIsWhite := s.playerIsWhite
+	clockRunning := s.clockRunning
+	initialMs := s.initialMs
+	incrementMs := s.incrementMs
+	lastMessage := s.lastMessage
+	s.mu.Unlock()
+
+	sans := make([]string, 0, len(moves))
+	for i := range moves {
+		san, err := s.engine.San(base, moves[:i+1])
+		if err != nil {
+			return "", err
+		}
+		sans = append(sans, san)
+	}
+
+	white, black := "Player", "Engine"
+	if !playerIsWhite {
+		white, black = "Engine", "Player"
+	}
+	timeControl := "-"
+	if clockRunning {
+		timeControl = fmt.Sprintf("%d+%d", initialMs/1000, incrementMs/1000)
+	}
+
+	result := pgnResult(lastMessage, playerIsWhite)
+
+	var buf strings.Builder
+	fmt.Fprintf(&buf, "[White \"%s\"]\n", white)
+	fmt.Fprintf(&buf, "[Black \"%s\"]\n", black)
+	fmt.Fprintf(&buf, "[Result \"%s\"]\n", result)
+	fmt.Fprintf(&buf, "[TimeControl \"%s\"]\n\n", timeControl)
+	for i, san := range sans {
+		if i%2 == 0 {
+			fmt.Fprintf(&buf, "%d. ", i/2+1)
+		}
+		buf.WriteString(san)
+		buf.WriteByte(' ')
+	}
+	buf.WriteString(result)
+	return buf.String(), nil
+}
+
 func (s *Session) SendState(ws *WsConn, status, engineMove, message string) error {
-	fen, err := s.engine.Fen(s.moves)
+	s.lastStatus = status
+	s.lastMessage = message
+	fen, err := s.engine.Fen(s.basePosition, s.moves)
 	if err != nil {
 		return err
 	}
@@ -507,136 +1209,692 @@ func (s *Session) SendState(ws *WsConn, status, engineMove, message string) erro
 		Status:     status,
 		Message:    message,
 	}
+	if s.clockRunning {
+		state.WhiteMs = s.whiteMs
+		state.BlackMs = s.blackMs
+	}
 	return ws.WriteJSON(state)
 }
 
-func handleSession(ws *WsConn, enginePath string, depth int, movetimeMs int) {
-	defer ws.Close()
+// Lobby pairs two human players on the same Session-style position, using an
+// EngineProcess purely as a rules/FEN oracle (LegalMoves/Fen/InCheck) and
+// never issuing "go". Membership is mutex-protected because the host and
+// joiner each run in their own handleSession goroutine.
+type Lobby struct {
+	mu         sync.Mutex
+	passphrase string
+	engine     *EngineProcess
+	moves      []string
+	white      *WsConn
+	black      *WsConn
+}
 
-	engine, err := startEngine(enginePath)
+func (l *Lobby) colorOf(ws *WsConn) (isWhite bool, ok bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	switch ws {
+	case l.white:
+		return true, true
+	case l.black:
+		return false, true
+	default:
+		return false, false
+	}
+}
+
+func (l *Lobby) ready() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.white != nil && l.black != nil
+}
+
+func (l *Lobby) broadcastState(status, message string) error {
+	l.mu.Lock()
+	moves := append([]string(nil), l.moves...)
+	white, black := l.white, l.black
+	l.mu.Unlock()
+
+	fen, err := l.engine.Fen("", moves)
 	if err != nil {
-		_ = ws.WriteJSON(ServerMessage{Type: "error", Message: err.Error()})
-		return
+		return err
+	}
+	state := ServerMessage{Type: "state", Fen: fen, Moves: moves, Status: status, Message: message}
+	if white != nil {
+		_ = white.WriteJSON(state)
+	}
+	if black != nil {
+		_ = black.WriteJSON(state)
 	}
-	defer engine.Close()
+	return nil
+}
+
+func (l *Lobby) applyMove(ws *WsConn, uci string) error {
+	isWhite, ok := l.colorOf(ws)
+	if !ok {
+		return errors.New("not a player in this lobby")
+	}
+	l.mu.Lock()
+	moves := append([]string(nil), l.moves...)
+	l.mu.Unlock()
 
-	session := &Session{
-		engine:        engine,
-		depth:         depth,
-		movetimeMs:    movetimeMs,
-		playerIsWhite: true,
+	if sideToMoveIsWhite(moves) != isWhite {
+		return errors.New("not your move")
 	}
-	status, message, engineMove, err := session.Reset(true)
+	legalMoves, err := l.engine.LegalMoves("", moves)
 	if err != nil {
-		_ = ws.WriteJSON(ServerMessage{Type: "error", Message: err.Error()})
-		return
+		return err
+	}
+	if !containsMove(legalMoves, uci) {
+		return errors.New("illegal move")
 	}
+	l.mu.Lock()
+	l.moves = append(l.moves, uci)
+	l.mu.Unlock()
+	return nil
+}
 
-	if err := session.SendState(ws, status, engineMove, message); err != nil {
-		_ = ws.WriteJSON(ServerMessage{Type: "error", Message: err.Error()})
-		return
+// leave clears ws's seat, if it holds one. It reports whether both seats are
+// now empty, in which case the caller should tear the lobby down — while the
+// other player is still seated, the lobby (and its shared engine) must stay
+// alive so they keep a working connection.
+func (l *Lobby) leave(ws *WsConn) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	switch ws {
+	case l.white:
+		l.white = nil
+	case l.black:
+		l.black = nil
+	}
+	return l.white == nil && l.black == nil
+}
+
+func (l *Lobby) Close() {
+	l.engine.Close()
+}
+
+// LobbyManager tracks in-progress PvP lobbies by passphrase.
+type LobbyManager struct {
+	mu      sync.Mutex
+	lobbies map[string]*Lobby
+}
+
+func NewLobbyManager() *LobbyManager {
+	return &LobbyManager{lobbies: make(map[string]*Lobby)}
+}
+
+func (m *LobbyManager) host(enginePath string, hostWs *WsConn, hostIsWhite bool) (*Lobby, error) {
+	engine, err := startEngine(enginePath)
+	if err != nil {
+		return nil, err
+	}
+	if err := engine.NewGame(); err != nil {
+		engine.Close()
+		return nil, err
 	}
 
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var passphrase string
 	for {
-		payload, err := ws.ReadMessage()
+		candidate, err := generatePassphrase()
 		if err != nil {
-			return
+			engine.Close()
+			return nil, err
 		}
-		var msg ClientMessage
-		if err := json.Unmarshal(payload, &msg); err != nil {
-			_ = ws.WriteJSON(ServerMessage{Type: "error", Message: "invalid json"})
+		if _, exists := m.lobbies[candidate]; !exists {
+			passphrase = candidate
+			break
+		}
+	}
+
+	lobby := &Lobby{passphrase: passphrase, engine: engine}
+	if hostIsWhite {
+		lobby.white = hostWs
+	} else {
+		lobby.black = hostWs
+	}
+	m.lobbies[passphrase] = lobby
+	return lobby, nil
+}
+
+func (m *LobbyManager) join(passphrase string, ws *WsConn) (*Lobby, error) {
+	m.mu.Lock()
+	lobby, ok := m.lobbies[passphrase]
+	m.mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("no lobby for passphrase %q", passphrase)
+	}
+
+	lobby.mu.Lock()
+	defer lobby.mu.Unlock()
+	switch {
+	case lobby.white == nil:
+		lobby.white = ws
+	case lobby.black == nil:
+		lobby.black = ws
+	default:
+		return nil, errors.New("lobby is full")
+	}
+	return lobby, nil
+}
+
+func (m *LobbyManager) remove(lobby *Lobby) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if current, ok := m.lobbies[lobby.passphrase]; ok && current == lobby {
+		delete(m.lobbies, lobby.passphrase)
+	}
+}
+
+const (
+	passphraseAlphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789" // no 0/O/1/I
+	passphraseLength   = 6
+)
+
+func generatePassphrase() (string, error) {
+	buf := make([]byte, passphraseLength)
+	for i := range buf {
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(passphraseAlphabet))))
+		if err != nil {
+			return "", err
+		}
+		buf[i] = passphraseAlphabet[n.Int64()]
+	}
+	return string(buf), nil
+}
+
+func randomIsWhite() bool {
+	n, err := rand.Int(rand.Reader, big.NewInt(2))
+	if err != nil {
+		return true
+	}
+	return n.Int64() == 0
+}
+
+func handleLobbySession(ws *WsConn, lobbies *LobbyManager, enginePath string, first ClientMessage) {
+	var lobby *Lobby
+	switch first.Type {
+	case "host":
+		var err error
+		hostIsWhite := randomIsWhite()
+		if first.Color != "" {
+			hostIsWhite = parsePlayerColor(first.Color, hostIsWhite)
+		}
+		lobby, err = lobbies.host(enginePath, ws, hostIsWhite)
+		if err != nil {
+			_ = ws.WriteJSON(ServerMessage{Type: "error", Message: err.Error()})
+			return
+		}
+		if err := ws.WriteJSON(ServerMessage{Type: "lobby", Passphrase: lobby.passphrase}); err != nil {
+			lobbies.remove(lobby)
+			lobby.Close()
+			return
+		}
+	case "join":
+		var err error
+		lobby, err = lobbies.join(strings.TrimSpace(first.Passphrase), ws)
+		if err != nil {
+			_ = ws.WriteJSON(ServerMessage{Type: "error", Message: err.Error()})
+			return
+		}
+	}
+
+	if lobby.ready() {
+		_ = lobby.broadcastState("Your move", "")
+	}
+
+	for {
+		payload, err := ws.ReadMessage()
+		if err != nil {
+			break
+		}
+		var msg ClientMessage
+		if err := json.Unmarshal(payload, &msg); err != nil {
+			_ = ws.WriteJSON(ServerMessage{Type: "error", Message: "invalid json"})
 			continue
 		}
-		switch msg.Type {
-		case "new":
-			playerIsWhite := parsePlayerColor(msg.Color, session.playerIsWhite)
-			status, message, engineMove, err := session.Reset(playerIsWhite)
+		if msg.Type != "move" {
+			_ = ws.WriteJSON(ServerMessage{Type: "error", Message: "unknown command"})
+			continue
+		}
+		if !lobby.ready() {
+			_ = ws.WriteJSON(ServerMessage{Type: "error", Message: "waiting for opponent"})
+			continue
+		}
+		uci := strings.TrimSpace(msg.Uci)
+		if uci == "" {
+			_ = ws.WriteJSON(ServerMessage{Type: "error", Message: "missing move"})
+			continue
+		}
+		if err := lobby.applyMove(ws, uci); err != nil {
+			_ = ws.WriteJSON(ServerMessage{Type: "error", Message: err.Error()})
+			continue
+		}
+		_ = lobby.broadcastState("In progress", "")
+	}
+
+	if empty := lobby.leave(ws); empty {
+		lobbies.remove(lobby)
+		lobby.Close()
+	} else {
+		_ = lobby.broadcastState("Game over", "Opponent disconnected")
+	}
+}
+
+// StoredSession is a SessionStore entry: a long-lived Session (and the
+// EngineProcess backing it) plus whichever WsConn is currently attached to
+// it, if any. The engine, moves, playerIsWhite and movetimeMs all survive a
+// disconnect so a client can resume with the token.
+type StoredSession struct {
+	mu         sync.Mutex
+	token      string
+	session    *Session
+	ws         *WsConn
+	lastActive time.Time
+}
+
+func (st *StoredSession) attach(ws *WsConn) bool {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.ws != nil {
+		return false
+	}
+	st.ws = ws
+	st.lastActive = time.Now()
+	return true
+}
+
+func (st *StoredSession) detach(ws *WsConn) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.ws == ws {
+		st.ws = nil
+		st.lastActive = time.Now()
+	}
+}
+
+func (st *StoredSession) idleSince(now time.Time) (time.Duration, bool) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.ws != nil {
+		return 0, false
+	}
+	return now.Sub(st.lastActive), true
+}
+
+// SessionStore keeps engine-play Sessions alive across reconnects, keyed by
+// an opaque token, evicting ones that have been idle (no attached WsConn)
+// for longer than ttl. maxSize bounds the number of live entries (and so the
+// number of forked engine subprocesses) directly: a client that repeatedly
+// connects and disconnects would otherwise accumulate far more of those than
+// any per-connection limiter allows, since each survives up to ttl past its
+// connection closing.
+type SessionStore struct {
+	mu       sync.Mutex
+	sessions map[string]*StoredSession
+	ttl      time.Duration
+	maxSize  int // 0 disables the cap
+}
+
+func NewSessionStore(ttl time.Duration, maxSize int) *SessionStore {
+	store := &SessionStore{sessions: make(map[string]*StoredSession), ttl: ttl, maxSize: maxSize}
+	go store.reapLoop()
+	return store
+}
+
+func (s *SessionStore) reapLoop() {
+	ticker := time.NewTicker(time.Minute)
+	for range ticker.C {
+		s.reapExpired()
+	}
+}
+
+func (s *SessionStore) reapExpired() {
+	now := time.Now()
+	s.mu.Lock()
+	var expired []*StoredSession
+	for token, st := range s.sessions {
+		if idle, disconnected := st.idleSince(now); disconnected && idle > s.ttl {
+			expired = append(expired, st)
+			delete(s.sessions, token)
+		}
+	}
+	s.mu.Unlock()
+	for _, st := range expired {
+		st.session.engine.Close()
+	}
+}
+
+func (s *SessionStore) full() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.maxSize > 0 && len(s.sessions) >= s.maxSize
+}
+
+func (s *SessionStore) create(enginePath string, depth, movetimeMs int) (*StoredSession, error) {
+	if s.full() {
+		return nil, errors.New("too many concurrent engine sessions")
+	}
+
+	engine, err := startEngine(enginePath)
+	if err != nil {
+		return nil, err
+	}
+	token, err := generateToken()
+	if err != nil {
+		engine.Close()
+		return nil, err
+	}
+	st := &StoredSession{
+		token: token,
+		session: &Session{
+			engine:        engine,
+			depth:         depth,
+			movetimeMs:    movetimeMs,
+			playerIsWhite: true,
+		},
+		lastActive: time.Now(),
+	}
+
+	s.mu.Lock()
+	if s.maxSize > 0 && len(s.sessions) >= s.maxSize {
+		s.mu.Unlock()
+		engine.Close()
+		return nil, errors.New("too many concurrent engine sessions")
+	}
+	s.sessions[token] = st
+	s.mu.Unlock()
+	return st, nil
+}
+
+// resume attaches ws to the stored session for token. It reports false if
+// the token is unknown or already has a live connection attached — per
+// mchess-server, a second connect for an already-connected token is ignored
+// rather than tearing down the existing socket.
+// Get looks up a stored session by token without attaching a connection to
+// it, for read-only access such as the /pgn export endpoint.
+func (s *SessionStore) Get(token string) (*StoredSession, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st, ok := s.sessions[token]
+	return st, ok
+}
+
+func (s *SessionStore) resume(token string, ws *WsConn) (*StoredSession, bool) {
+	s.mu.Lock()
+	st, ok := s.sessions[token]
+	s.mu.Unlock()
+	if !ok {
+		return nil, false
+	}
+	return st, st.attach(ws)
+}
+
+func generateToken() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// handleSession dispatches a freshly upgraded WebSocket based on the first
+// client message: {"type":"host"} or {"type":"join","passphrase":"..."}
+// starts a PvP lobby, {"type":"resume","token":"..."} reattaches to an
+// existing engine-play session, anything else starts a new engine session.
+func handleSession(ws *WsConn, enginePath string, depth int, movetimeMs int, lobbies *LobbyManager, sessions *SessionStore) {
+	defer ws.Close()
+
+	payload, err := ws.ReadMessage()
+	if err != nil {
+		return
+	}
+	var first ClientMessage
+	if err := json.Unmarshal(payload, &first); err != nil {
+		_ = ws.WriteJSON(ServerMessage{Type: "error", Message: "invalid json"})
+		return
+	}
+
+	switch first.Type {
+	case "host", "join":
+		handleLobbySession(ws, lobbies, enginePath, first)
+	case "resume":
+		handleResumeSession(ws, sessions, first)
+	default:
+		handleEngineSession(ws, enginePath, depth, movetimeMs, sessions, first)
+	}
+}
+
+func handleResumeSession(ws *WsConn, sessions *SessionStore, first ClientMessage) {
+	st, ok := sessions.resume(strings.TrimSpace(first.Token), ws)
+	if !ok {
+		_ = ws.WriteJSON(ServerMessage{Type: "error", Message: "no resumable session for that token"})
+		return
+	}
+	defer st.detach(ws)
+
+	session := st.session
+	if err := session.SendState(ws, session.lastStatus, "", session.lastMessage); err != nil {
+		return
+	}
+	runEngineMessageLoop(ws, session)
+}
+
+func handleEngineSession(ws *WsConn, enginePath string, depth int, movetimeMs int, sessions *SessionStore, first ClientMessage) {
+	st, err := sessions.create(enginePath, depth, movetimeMs)
+	if err != nil {
+		_ = ws.WriteJSON(ServerMessage{Type: "error", Message: err.Error()})
+		return
+	}
+	st.attach(ws)
+	defer st.detach(ws)
+
+	if err := ws.WriteJSON(ServerMessage{Type: "session", Token: st.token}); err != nil {
+		return
+	}
+
+	session := st.session
+	status, message, engineMove, err := session.Reset(true, nil, infoCallback(ws))
+	if err != nil {
+		_ = ws.WriteJSON(ServerMessage{Type: "error", Message: err.Error()})
+		return
+	}
+
+	if err := session.SendState(ws, status, engineMove, message); err != nil {
+		return
+	}
+
+	handleEngineMessage(ws, session, first)
+	runEngineMessageLoop(ws, session)
+}
+
+func infoCallback(ws *WsConn) func(InfoUpdate) {
+	return func(update InfoUpdate) {
+		_ = ws.WriteJSON(infoServerMessage(update))
+	}
+}
+
+// runEngineMessageLoop reads client messages off ws and dispatches them to
+// handleEngineMessage. A "move" is run on its own goroutine since it blocks
+// on the engine's search; the loop keeps reading in the meantime so a
+// concurrent {"type":"stop"} can reach EngineProcess.Stop() while the move
+// is still in flight, instead of queuing up behind it.
+func runEngineMessageLoop(ws *WsConn, session *Session) {
+	msgCh := make(chan ClientMessage)
+	errCh := make(chan error, 1)
+	go func() {
+		for {
+			payload, err := ws.ReadMessage()
 			if err != nil {
-				_ = ws.WriteJSON(ServerMessage{Type: "error", Message: err.Error()})
-				continue
-			}
-			_ = session.SendState(ws, status, engineMove, message)
-		case "movetime":
-			value := msg.MovetimeMs
-			if value < 0 {
-				value = 0
-			}
-			if value > 10000 {
-				value = 10000
+				errCh <- err
+				return
 			}
-			session.movetimeMs = value
-		case "move":
-			uci := strings.TrimSpace(msg.Uci)
-			if uci == "" {
-				_ = ws.WriteJSON(ServerMessage{Type: "error", Message: "missing move"})
+			var msg ClientMessage
+			if err := json.Unmarshal(payload, &msg); err != nil {
+				_ = ws.WriteJSON(ServerMessage{Type: "error", Message: "invalid json"})
 				continue
 			}
-			legalMoves, err := session.engine.LegalMoves(session.moves)
-			if err != nil {
-				_ = ws.WriteJSON(ServerMessage{Type: "error", Message: err.Error()})
-				continue
+			msgCh <- msg
+		}
+	}()
+
+	var moveDone chan struct{}
+	for {
+		select {
+		case msg := <-msgCh:
+			switch {
+			case msg.Type == "stop":
+				_ = session.engine.Stop()
+			case moveDone != nil:
+				_ = ws.WriteJSON(ServerMessage{Type: "error", Message: "engine is thinking"})
+			case msg.Type == "move":
+				done := make(chan struct{})
+				moveDone = done
+				go func() {
+					handleEngineMessage(ws, session, msg)
+					close(done)
+				}()
+			default:
+				handleEngineMessage(ws, session, msg)
 			}
-			if !containsMove(legalMoves, uci) {
-				_ = ws.WriteJSON(ServerMessage{Type: "error", Message: "illegal move"})
-				continue
+		case <-moveDone:
+			moveDone = nil
+		case <-errCh:
+			// Don't return while a move goroutine is still running: the
+			// caller's deferred detach() would let a near-simultaneous
+			// "resume" reattach and start a second message loop against
+			// the same Session/EngineProcess while the orphaned goroutine
+			// is still calling BestMoveStream/appendMove/SendState on it.
+			if moveDone != nil {
+				<-moveDone
 			}
-			session.moves = append(session.moves, uci)
-			engineMoves, err := session.engine.LegalMoves(session.moves)
+			return
+		}
+	}
+}
+
+func handleEngineMessage(ws *WsConn, session *Session, msg ClientMessage) {
+	switch msg.Type {
+	case "new":
+		playerIsWhite := parsePlayerColor(msg.Color, session.playerIsWhite)
+		status, message, engineMove, err := session.Reset(playerIsWhite, msg.Tc, infoCallback(ws))
+		if err != nil {
+			_ = ws.WriteJSON(ServerMessage{Type: "error", Message: err.Error()})
+			return
+		}
+		_ = session.SendState(ws, status, engineMove, message)
+	case "movetime":
+		value := msg.MovetimeMs
+		if value < 0 {
+			value = 0
+		}
+		if value > 10000 {
+			value = 10000
+		}
+		session.movetimeMs = value
+	case "load":
+		fen := strings.TrimSpace(msg.Fen)
+		if fen == "" {
+			_ = ws.WriteJSON(ServerMessage{Type: "error", Message: "missing fen"})
+			return
+		}
+		if err := session.LoadPosition(fen, msg.Moves); err != nil {
+			_ = ws.WriteJSON(ServerMessage{Type: "error", Message: err.Error()})
+			return
+		}
+		_ = session.SendState(ws, "Your move", "", "")
+	case "pgn":
+		pgn, err := session.PGN()
+		if err != nil {
+			_ = ws.WriteJSON(ServerMessage{Type: "error", Message: err.Error()})
+			return
+		}
+		_ = ws.WriteJSON(ServerMessage{Type: "pgn", Pgn: pgn})
+	case "move":
+		uci := strings.TrimSpace(msg.Uci)
+		if uci == "" {
+			_ = ws.WriteJSON(ServerMessage{Type: "error", Message: "missing move"})
+			return
+		}
+		legalMoves, err := session.engine.LegalMoves(session.basePosition, session.moves)
+		if err != nil {
+			_ = ws.WriteJSON(ServerMessage{Type: "error", Message: err.Error()})
+			return
+		}
+		if !containsMove(legalMoves, uci) {
+			_ = ws.WriteJSON(ServerMessage{Type: "error", Message: "illegal move"})
+			return
+		}
+		if forfeited := session.tick(sideToMoveIsWhite(session.moves)); forfeited {
+			message := timeForfeitMessage(sideToMoveIsPlayer(session.moves, session.playerIsWhite))
+			_ = session.SendState(ws, "Game over", "", message)
+			return
+		}
+		session.appendMove(uci)
+		engineMoves, err := session.engine.LegalMoves(session.basePosition, session.moves)
+		if err != nil {
+			_ = ws.WriteJSON(ServerMessage{Type: "error", Message: err.Error()})
+			return
+		}
+		if len(engineMoves) == 0 {
+			inCheck, err := session.engine.InCheck(session.basePosition, session.moves)
 			if err != nil {
 				_ = ws.WriteJSON(ServerMessage{Type: "error", Message: err.Error()})
-				continue
-			}
-			if len(engineMoves) == 0 {
-				inCheck, err := session.engine.InCheck(session.moves)
-				if err != nil {
-					_ = ws.WriteJSON(ServerMessage{Type: "error", Message: err.Error()})
-					continue
-				}
-				message := gameOverMessage(session.moves, session.playerIsWhite, inCheck)
-				_ = session.SendState(ws, "Game over", "", message)
-				continue
+				return
 			}
+			message := gameOverMessage(session.moves, session.playerIsWhite, inCheck)
+			_ = session.SendState(ws, "Game over", "", message)
+			return
+		}
 
-			if err := session.SendState(ws, "Engine thinking", "", ""); err != nil {
+		if err := session.SendState(ws, "Engine thinking", "", ""); err != nil {
+			_ = ws.WriteJSON(ServerMessage{Type: "error", Message: err.Error()})
+			return
+		}
+		session.startClock()
+		bestMove, err := session.engine.BestMoveStream(session.basePosition, session.moves, session.searchLimits(), infoCallback(ws))
+		if err != nil {
+			_ = ws.WriteJSON(ServerMessage{Type: "error", Message: err.Error()})
+			return
+		}
+		if forfeited := session.tick(sideToMoveIsWhite(session.moves)); forfeited {
+			message := timeForfeitMessage(sideToMoveIsPlayer(session.moves, session.playerIsWhite))
+			_ = session.SendState(ws, "Game over", "", message)
+			return
+		}
+		status := "Your move"
+		message := ""
+		if bestMove == "" || bestMove == "(none)" || bestMove == "0000" {
+			inCheck, err := session.engine.InCheck(session.basePosition, session.moves)
+			if err != nil {
 				_ = ws.WriteJSON(ServerMessage{Type: "error", Message: err.Error()})
-				continue
+				return
 			}
-			bestMove, err := session.engine.BestMove(session.moves, session.depth, session.movetimeMs)
+			status = "Game over"
+			message = gameOverMessage(session.moves, session.playerIsWhite, inCheck)
+		} else {
+			session.appendMove(bestMove)
+			playerMoves, err := session.engine.LegalMoves(session.basePosition, session.moves)
 			if err != nil {
 				_ = ws.WriteJSON(ServerMessage{Type: "error", Message: err.Error()})
-				continue
+				return
 			}
-			status := "Your move"
-			message := ""
-			if bestMove == "" || bestMove == "(none)" || bestMove == "0000" {
-				inCheck, err := session.engine.InCheck(session.moves)
+			if len(playerMoves) == 0 {
+				inCheck, err := session.engine.InCheck(session.basePosition, session.moves)
 				if err != nil {
 					_ = ws.WriteJSON(ServerMessage{Type: "error", Message: err.Error()})
-					continue
+					return
 				}
 				status = "Game over"
 				message = gameOverMessage(session.moves, session.playerIsWhite, inCheck)
 			} else {
-				session.moves = append(session.moves, bestMove)
-				playerMoves, err := session.engine.LegalMoves(session.moves)
-				if err != nil {
-					_ = ws.WriteJSON(ServerMessage{Type: "error", Message: err.Error()})
-					continue
-				}
-				if len(playerMoves) == 0 {
-					inCheck, err := session.engine.InCheck(session.moves)
-					if err != nil {
-						_ = ws.WriteJSON(ServerMessage{Type: "error", Message: err.Error()})
-						continue
-					}
-					status = "Game over"
-					message = gameOverMessage(session.moves, session.playerIsWhite, inCheck)
-				}
+				session.startClock()
 			}
-			_ = session.SendState(ws, status, bestMove, message)
-		default:
-			_ = ws.WriteJSON(ServerMessage{Type: "error", Message: "unknown command"})
 		}
+		_ = session.SendState(ws, status, bestMove, message)
+	default:
+		_ = ws.WriteJSON(ServerMessage{Type: "error", Message: "unknown command"})
 	}
 }
 
@@ -660,28 +1918,200 @@ func defaultEnginePath() string {
 	return filepath.Join(cwd, "build", "engine", "flare_engine")
 }
 
+// UpgradeLimiter is a per-key token-bucket limiter guarding /ws upgrade
+// attempts, keyed by client IP. A zero rate disables limiting.
+type UpgradeLimiter struct {
+	mu      sync.Mutex
+	rate    float64
+	burst   float64
+	buckets map[string]*tokenBucket
+}
+
+type tokenBucket struct {
+	tokens   float64
+	lastSeen time.Time
+}
+
+// upgradeLimiterIdleTTL is how long an IP's bucket may sit untouched before
+// reapLoop discards it. By then the bucket would have refilled to full burst
+// anyway, so recreating it from scratch on the IP's next Allow() call looks
+// identical to the caller — this only bounds memory for IPs that stop
+// connecting.
+const upgradeLimiterIdleTTL = 10 * time.Minute
+
+func NewUpgradeLimiter(qps float64) *UpgradeLimiter {
+	l := &UpgradeLimiter{
+		rate:    qps,
+		burst:   math.Max(1, qps),
+		buckets: make(map[string]*tokenBucket),
+	}
+	go l.reapLoop()
+	return l
+}
+
+func (l *UpgradeLimiter) reapLoop() {
+	ticker := time.NewTicker(time.Minute)
+	for range ticker.C {
+		l.reapExpired()
+	}
+}
+
+func (l *UpgradeLimiter) reapExpired() {
+	cutoff := time.Now().Add(-upgradeLimiterIdleTTL)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for key, bucket := range l.buckets {
+		if bucket.lastSeen.Before(cutoff) {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+func (l *UpgradeLimiter) Allow(key string) bool {
+	if l.rate <= 0 {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	bucket, ok := l.buckets[key]
+	if !ok {
+		l.buckets[key] = &tokenBucket{tokens: l.burst - 1, lastSeen: now}
+		return true
+	}
+	bucket.tokens = math.Min(l.burst, bucket.tokens+now.Sub(bucket.lastSeen).Seconds()*l.rate)
+	bucket.lastSeen = now
+	if bucket.tokens < 1 {
+		return false
+	}
+	bucket.tokens--
+	return true
+}
+
+// SessionLimiter enforces a global cap on concurrent engine/lobby sessions
+// plus a per-IP cap, so a single client can't fork-bomb the host. A zero
+// limit disables that particular cap.
+type SessionLimiter struct {
+	mu       sync.Mutex
+	maxTotal int
+	maxPerIP int
+	total    int
+	perIP    map[string]int
+}
+
+func NewSessionLimiter(maxTotal, maxPerIP int) *SessionLimiter {
+	return &SessionLimiter{maxTotal: maxTotal, maxPerIP: maxPerIP, perIP: make(map[string]int)}
+}
+
+func (l *SessionLimiter) Acquire(ip string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.maxTotal > 0 && l.total >= l.maxTotal {
+		return false
+	}
+	if l.maxPerIP > 0 && l.perIP[ip] >= l.maxPerIP {
+		return false
+	}
+	l.total++
+	l.perIP[ip]++
+	return true
+}
+
+func (l *SessionLimiter) Release(ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.total--
+	l.perIP[ip]--
+	if l.perIP[ip] <= 0 {
+		delete(l.perIP, ip)
+	}
+}
+
+func (l *SessionLimiter) ActiveSessions() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.total
+}
+
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
 func main() {
 	addr := flag.String("addr", "127.0.0.1:8080", "listen address")
 	enginePath := flag.String("engine", defaultEnginePath(), "path to engine binary")
 	depth := flag.Int("depth", 4, "search depth for engine replies")
 	movetimeMs := flag.Int("movetime", 1000, "search time per move in ms (overrides depth when > 0)")
 	staticDir := flag.String("static", "static", "static file directory")
+	maxSessions := flag.Int("max-sessions", 64, "global concurrent /ws session cap (0 disables)")
+	perIPSessions := flag.Int("per-ip-sessions", 4, "per-IP concurrent /ws session cap (0 disables)")
+	upgradeQps := flag.Float64("upgrade-qps", 2, "allowed /ws upgrade attempts per second per IP (0 disables)")
+	maxMessageBytes := flag.Int("max-message-bytes", defaultMaxMessageSize, "max reassembled websocket message size in bytes")
 	flag.Parse()
 
+	upgradeLimiter := NewUpgradeLimiter(*upgradeQps)
+	sessionLimiter := NewSessionLimiter(*maxSessions, *perIPSessions)
+
 	mux := http.NewServeMux()
 	mux.HandleFunc("/healthz", func(w http.ResponseWriter, _ *http.Request) {
-		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-		w.WriteHeader(http.StatusOK)
-		_, _ = w.Write([]byte("ok"))
+		stats := struct {
+			Status         string  `json:"status"`
+			ActiveSessions int     `json:"active_sessions"`
+			MaxSessions    int     `json:"max_sessions"`
+			PerIPSessions  int     `json:"per_ip_sessions"`
+			UpgradeQps     float64 `json:"upgrade_qps"`
+		}{
+			Status:         "ok",
+			ActiveSessions: sessionLimiter.ActiveSessions(),
+			MaxSessions:    *maxSessions,
+			PerIPSessions:  *perIPSessions,
+			UpgradeQps:     *upgradeQps,
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(stats)
 	})
 	mux.Handle("/", http.FileServer(http.Dir(*staticDir)))
+	lobbies := NewLobbyManager()
+	sessions := NewSessionStore(10*time.Minute, *maxSessions)
 	mux.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
-		ws, err := upgradeToWebSocket(w, r)
+		ip := clientIP(r)
+		if !upgradeLimiter.Allow(ip) {
+			http.Error(w, "too many upgrade attempts", http.StatusTooManyRequests)
+			return
+		}
+		if !sessionLimiter.Acquire(ip) {
+			http.Error(w, "too many concurrent sessions", http.StatusServiceUnavailable)
+			return
+		}
+		ws, err := upgradeToWebSocket(w, r, *maxMessageBytes)
 		if err != nil {
+			sessionLimiter.Release(ip)
 			http.Error(w, "websocket upgrade failed", http.StatusBadRequest)
 			return
 		}
-		go handleSession(ws, *enginePath, *depth, *movetimeMs)
+		go func() {
+			defer sessionLimiter.Release(ip)
+			handleSession(ws, *enginePath, *depth, *movetimeMs, lobbies, sessions)
+		}()
+	})
+	mux.HandleFunc("/pgn", func(w http.ResponseWriter, r *http.Request) {
+		st, ok := sessions.Get(r.URL.Query().Get("token"))
+		if !ok {
+			http.Error(w, "unknown token", http.StatusNotFound)
+			return
+		}
+		pgn, err := st.session.PGN()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/x-chess-pgn")
+		_, _ = w.Write([]byte(pgn))
 	})
 
 	log.Printf("listening on http://%s", *addr)
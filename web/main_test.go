@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestSanitizeFEN(t *testing.T) {
+	cases := []struct {
+		name string
+		fen  string
+		ok   bool
+	}{
+		{"startpos", "rnbqkbnr/pppppppp/8/8/8/8/PPPPPPPP/RNBQKBNR w KQkq - 0 1", true},
+		{"no castling rights", "8/8/8/8/8/8/8/8 w - - 12 34", true},
+		{"wrong field count", "rnbqkbnr/pppppppp/8/8/8/8/PPPPPPPP/RNBQKBNR w KQkq -", false},
+		{"bad board field", "rnbqkbnr/pppppppp/8/8/8/8/PPPPPPPP/RNBQKBN? w KQkq - 0 1", false},
+		{"bad side to move", "8/8/8/8/8/8/8/8 x - - 0 1", false},
+		{"bad castling field", "8/8/8/8/8/8/8/8 w XYZ - 0 1", false},
+		{"bad en passant field", "8/8/8/8/8/8/8/8 w - z9 0 1", false},
+		{"non-numeric halfmove clock", "8/8/8/8/8/8/8/8 w - - x 1", false},
+		// An embedded newline would let a crafted FEN smuggle an extra UCI
+		// command (e.g. "quit") onto the engine's stdin once spliced into a
+		// "position fen ..." line; it must never come out the other side.
+		{"embedded newline smuggles a command", "8/8/8/8/8/8/8/8 w - -\nquit 0 1", false},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			clean, ok := sanitizeFEN(tc.fen)
+			if ok != tc.ok {
+				t.Fatalf("sanitizeFEN(%q) ok = %v, want %v", tc.fen, ok, tc.ok)
+			}
+			if ok && strings.Contains(clean, "\n") {
+				t.Fatalf("sanitizeFEN(%q) returned %q containing a newline", tc.fen, clean)
+			}
+		})
+	}
+}
+
+func TestSanitizeMoves(t *testing.T) {
+	cases := []struct {
+		name  string
+		moves []string
+		ok    bool
+	}{
+		{"empty", nil, true},
+		{"simple moves", []string{"e2e4", "e7e5", "g1f3"}, true},
+		{"promotion", []string{"e7e8q"}, true},
+		{"bad square", []string{"e2e9"}, false},
+		{"trailing garbage", []string{"e2e4 quit"}, false},
+		{"embedded newline smuggles a command", []string{"e2e4\nquit"}, false},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			clean, ok := sanitizeMoves(tc.moves)
+			if ok != tc.ok {
+				t.Fatalf("sanitizeMoves(%v) ok = %v, want %v", tc.moves, ok, tc.ok)
+			}
+			for _, move := range clean {
+				if strings.ContainsAny(move, "\n ") {
+					t.Fatalf("sanitizeMoves(%v) returned %q containing whitespace", tc.moves, move)
+				}
+			}
+		})
+	}
+}
+
+// maskedFrame builds one client->server WebSocket frame (always masked, per
+// RFC 6455) carrying payload as a single fin text frame.
+func maskedFrame(payload []byte) []byte {
+	maskKey := [4]byte{0x12, 0x34, 0x56, 0x78}
+	masked := make([]byte, len(payload))
+	for i, b := range payload {
+		masked[i] = b ^ maskKey[i%4]
+	}
+
+	var buf bytes.Buffer
+	buf.WriteByte(0x80 | opText)
+	if len(payload) >= 126 {
+		panic("maskedFrame: payload too large for this test helper")
+	}
+	buf.WriteByte(0x80 | byte(len(payload)))
+	buf.Write(maskKey[:])
+	buf.Write(masked)
+	return buf.Bytes()
+}
+
+func TestReadFrameRoundTrip(t *testing.T) {
+	payload := []byte("hello websocket")
+	reader := bufio.NewReader(bytes.NewReader(maskedFrame(payload)))
+
+	opcode, fin, rsv1, got, err := readFrame(reader, defaultMaxMessageSize)
+	if err != nil {
+		t.Fatalf("readFrame: %v", err)
+	}
+	if opcode != opText || !fin || rsv1 {
+		t.Fatalf("readFrame returned opcode=%d fin=%v rsv1=%v", opcode, fin, rsv1)
+	}
+	if !bytes.Equal(got, payload) {
+		t.Fatalf("readFrame payload = %q, want %q", got, payload)
+	}
+}
+
+func TestReadFrameRejectsOversizedLengthWithoutAllocating(t *testing.T) {
+	// A declared length over maxSize must be rejected before the payload (and
+	// any mask key) is even read off the wire, so a tiny malicious header
+	// can't force a huge allocation.
+	var buf bytes.Buffer
+	buf.WriteByte(0x80 | opText)
+	buf.WriteByte(0x80 | 127)
+	length := uint64(10 << 20) // 10MiB, over the 1MiB default cap
+	for i := 7; i >= 0; i-- {
+		buf.WriteByte(byte(length >> (8 * uint(i))))
+	}
+	// Deliberately omit the mask key and payload: if readFrame tried to
+	// allocate or read them, it would fail with an unexpected EOF instead of
+	// the size-limit error this test checks for.
+
+	reader := bufio.NewReader(bytes.NewReader(buf.Bytes()))
+	_, _, _, _, err := readFrame(reader, defaultMaxMessageSize)
+	if err == nil {
+		t.Fatal("readFrame accepted a frame declaring a length over maxSize")
+	}
+}
+
+func TestWsConnInflateCapsDecompressedSize(t *testing.T) {
+	// A highly compressible payload: small on the wire, huge once inflated —
+	// the shape of a zip/deflate bomb.
+	bomb := bytes.Repeat([]byte{0}, 1<<20) // 1MiB of zeroes
+
+	writer := &WsConn{maxMessageSize: defaultMaxMessageSize}
+	compressed, err := writer.compressLocked(bomb)
+	if err != nil {
+		t.Fatalf("compressLocked: %v", err)
+	}
+	if len(compressed) >= len(bomb) {
+		t.Fatalf("test payload did not compress (compressed=%d, original=%d)", len(compressed), len(bomb))
+	}
+
+	reader := &WsConn{maxMessageSize: 1024}
+	if _, err := reader.inflate(compressed); err == nil {
+		t.Fatal("inflate accepted a payload that decompresses past maxMessageSize")
+	}
+}
+
+func TestWsConnCompressInflateRoundTripWithContextTakeover(t *testing.T) {
+	writer := &WsConn{maxMessageSize: defaultMaxMessageSize}
+	reader := &WsConn{maxMessageSize: defaultMaxMessageSize}
+
+	messages := [][]byte{
+		[]byte(`{"type":"move","uci":"e2e4"}`),
+		[]byte(`{"type":"move","uci":"e7e5"}`),
+		[]byte(`{"type":"move","uci":"g1f3"}`),
+	}
+	for i, want := range messages {
+		compressed, err := writer.compressLocked(want)
+		if err != nil {
+			t.Fatalf("message %d: compressLocked: %v", i, err)
+		}
+		got, err := reader.inflate(compressed)
+		if err != nil {
+			t.Fatalf("message %d: inflate: %v", i, err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Fatalf("message %d: inflate = %q, want %q", i, got, want)
+		}
+	}
+	if len(reader.readDict) == 0 {
+		t.Fatal("context takeover: reader's dictionary should carry bytes across messages")
+	}
+}
+
+func TestWsConnNoContextTakeoverResetsDictionary(t *testing.T) {
+	writer := &WsConn{maxMessageSize: defaultMaxMessageSize, noContextTakeoverWrite: true}
+	reader := &WsConn{maxMessageSize: defaultMaxMessageSize, noContextTakeoverRead: true}
+
+	for _, want := range [][]byte{[]byte("first message"), []byte("second message")} {
+		compressed, err := writer.compressLocked(want)
+		if err != nil {
+			t.Fatalf("compressLocked: %v", err)
+		}
+		got, err := reader.inflate(compressed)
+		if err != nil {
+			t.Fatalf("inflate: %v", err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Fatalf("inflate = %q, want %q", got, want)
+		}
+		if reader.readDict != nil {
+			t.Fatal("client_no_context_takeover: readDict should stay nil across messages")
+		}
+	}
+}